@@ -170,6 +170,13 @@ func main() {
 }
 
 func showSourceLine(src []byte, pos lexer.Position, dividerLen int) {
+	if pos.File != "" {
+		// A #line directive means pos.Line no longer corresponds to a
+		// physical line in src, so there's no line to show -- just
+		// say where the generated source claims the error came from.
+		fmt.Fprintf(os.Stderr, "%s:%d:%d:\n", pos.File, pos.Line, pos.Column)
+		return
+	}
 	divider := strings.Repeat("-", dividerLen)
 	if divider != "" {
 		fmt.Fprintln(os.Stderr, divider)
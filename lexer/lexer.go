@@ -10,26 +10,50 @@ package lexer
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"unicode/utf8"
 )
 
 // Lexer tokenizes a byte string of AWK source code. Use NewLexer to
 // actually create a lexer, and Scan() or ScanRegex() to get tokens.
 type Lexer struct {
-	src      []byte
-	offset   int
-	ch       rune
-	errorMsg string
-	pos      Position
-	nextPos  Position
-	hadSpace bool
-	lastTok  Token
+	src       []byte
+	offset    int
+	ch        rune
+	errorMsg  string
+	pos       Position
+	nextPos   Position
+	hadSpace  bool
+	lastTok   Token
+	lineDelta int
+	curFile   string
+	lastError *Error
 }
 
 // Position stores the source line and column where a token starts.
+// File is normally empty, but is set when a #line directive (see
+// parseLineDirective) has overridden the reported source location,
+// for example because the program was produced by a preprocessor.
 type Position struct {
 	Line   int
 	Column int
+	File   string
+}
+
+// Error is a lexical error spanning a range of source rather than
+// just a single point, so callers (error messages, editor plugins,
+// linters) can underline the whole offending token instead of a
+// single caret. Msg is the same string that Scan or ScanRegex
+// returns as the ILLEGAL token's value.
+type Error struct {
+	Start Position
+	End   Position
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Start.Line, e.Start.Column, e.Msg)
 }
 
 // NewLexer creates a new lexer that will tokenize the given source
@@ -42,6 +66,21 @@ func NewLexer(src []byte) *Lexer {
 	return l
 }
 
+// curOffset returns the byte offset of l.ch within src -- that is, the
+// offset *before* the most recent next() call advanced past it. Scan
+// loops that slice src directly (for the zero-copy NAME/NUMBER/STRING/
+// REGEX fast paths) must use this rather than l.offset itself: by the
+// time a loop condition sees a delimiter in l.ch, l.offset already
+// points past it.
+func (l *Lexer) curOffset() int {
+	if l.ch < 0 {
+		// At EOF or on an invalid UTF-8 byte, next() doesn't advance
+		// l.offset, so it already marks where scanning stopped.
+		return l.offset
+	}
+	return l.offset - utf8.RuneLen(l.ch)
+}
+
 // HadSpace returns true if the previously-scanned token had
 // whitespace before it. Used by the parser because when calling a
 // user-defined function the grammar doesn't allow a space between
@@ -58,30 +97,56 @@ func (l *Lexer) HadSpace() bool {
 func (l *Lexer) Scan() (Position, Token, string) {
 	pos, tok, val := l.scan()
 	l.lastTok = tok
+	pos = l.reportPosition(pos)
+	l.lastError = nil
+	if tok == ILLEGAL {
+		l.lastError = &Error{Start: pos, End: l.reportPosition(l.pos), Msg: val}
+	}
 	return pos, tok, val
 }
 
+// LastError returns the range-ful error for the most recently scanned
+// token, or nil if that token wasn't ILLEGAL. Scan and ScanRegex only
+// return a single Position plus the error message string for
+// backwards compatibility; callers that want the full token range
+// (for example to underline it with "^~~~~") should use this instead.
+func (l *Lexer) LastError() *Error {
+	return l.lastError
+}
+
+// reportPosition applies any #line directive override (see
+// parseLineDirective) to pos before it's handed back to the caller.
+func (l *Lexer) reportPosition(pos Position) Position {
+	pos.Line += l.lineDelta
+	pos.File = l.curFile
+	return pos
+}
+
 func (l *Lexer) scan() (Position, Token, string) {
 	l.hadSpace = false
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\r' || l.ch == '\\' {
 		l.hadSpace = true
 		if l.ch == '\\' {
+			backslashPos := l.pos
 			l.next()
 			if l.ch == '\r' {
 				l.next()
 			}
 			if l.ch != '\n' {
-				return l.pos, ILLEGAL, "expected \\n after \\ line continuation"
+				return backslashPos, ILLEGAL, "expected \\n after \\ line continuation"
 			}
 		}
 		l.next()
 	}
 	if l.ch == '#' {
-		// Skip comment till end of line
+		// Skip comment till end of line, checking for a "#line NNN
+		// "filename"" directive along the way.
 		l.next()
+		start := l.curOffset()
 		for l.ch != '\n' && l.ch >= 0 {
 			l.next()
 		}
+		l.parseLineDirective(string(l.src[start:l.curOffset()]))
 	}
 	if l.ch < 0 {
 		if l.errorMsg != "" {
@@ -95,16 +160,15 @@ func (l *Lexer) scan() (Position, Token, string) {
 	val := ""
 
 	ch := l.ch
+	start := l.offset - utf8.RuneLen(ch)
 	l.next()
 
 	// Names: keywords and functions
 	if isNameStart(ch) {
-		runes := []rune{ch}
 		for isNameStart(l.ch) || (l.ch >= '0' && l.ch <= '9') {
-			runes = append(runes, l.ch)
 			l.next()
 		}
-		name := string(runes)
+		name := string(l.src[start:l.curOffset()])
 		tok, isKeyword := keywordTokens[name]
 		if !isKeyword {
 			tok = NAME
@@ -208,78 +272,93 @@ func (l *Lexer) scan() (Position, Token, string) {
 	case '&':
 		tok = l.choice('&', ILLEGAL, AND)
 		if tok == ILLEGAL {
-			return l.pos, ILLEGAL, fmt.Sprintf("unexpected %q after '&'", l.ch)
+			return pos, ILLEGAL, fmt.Sprintf("unexpected %q after '&'", l.ch)
 		}
 	case '|':
 		tok = l.choice('|', PIPE, OR)
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.':
-		runes := []rune{ch}
 		gotDigit := false
 		if ch != '.' {
 			gotDigit = true
 			for l.ch >= '0' && l.ch <= '9' {
-				runes = append(runes, l.ch)
 				l.next()
 			}
 			if l.ch == '.' {
-				runes = append(runes, l.ch)
 				l.next()
 			}
 		}
 		for l.ch >= '0' && l.ch <= '9' {
 			gotDigit = true
-			runes = append(runes, l.ch)
 			l.next()
 		}
 		if !gotDigit {
-			return l.pos, ILLEGAL, "expected digits"
+			return pos, ILLEGAL, "expected digits"
 		}
 		if l.ch == 'e' || l.ch == 'E' {
-			runes = append(runes, l.ch)
 			l.next()
 			if l.ch == '+' || l.ch == '-' {
-				runes = append(runes, l.ch)
 				l.next()
 			}
 			for l.ch >= '0' && l.ch <= '9' {
-				runes = append(runes, l.ch)
 				l.next()
 			}
 		}
 		tok = NUMBER
-		val = string(runes)
+		val = string(l.src[start:l.curOffset()])
 	case '"', '\'':
 		// Note: POSIX awk spec doesn't allow single-quoted strings,
 		// but this helps without quoting, especially on Windows
 		// where the shell quote character is " (double quote).
-		runes := []rune{}
+		escaped := false
 		for l.ch != ch {
 			c := l.ch
 			if c < 0 {
-				return l.pos, ILLEGAL, "didn't find end quote in string"
+				return pos, ILLEGAL, "didn't find end quote in string"
 			}
 			if c == '\r' || c == '\n' {
-				return l.pos, ILLEGAL, "can't have newline in string"
+				return pos, ILLEGAL, "can't have newline in string"
 			}
 			if c == '\\' {
-				l.next()
-				switch l.ch {
-				case 't':
-					c = '\t'
-				case 'r':
-					c = '\r'
-				case 'n':
-					c = '\n'
-				default:
-					c = l.ch
+				escaped = true
+				break
+			}
+			l.next()
+		}
+		if !escaped {
+			// Fast path: no escapes, so the token value is just a
+			// substring of src -- no rune-by-rune copy needed.
+			val = string(l.src[start+1 : l.curOffset()])
+			l.next()
+		} else {
+			runes := []rune(string(l.src[start+1 : l.offset-1]))
+			for l.ch != ch {
+				c := l.ch
+				if c < 0 {
+					return pos, ILLEGAL, "didn't find end quote in string"
+				}
+				if c == '\r' || c == '\n' {
+					return pos, ILLEGAL, "can't have newline in string"
+				}
+				if c == '\\' {
+					l.next()
+					switch l.ch {
+					case 't':
+						c = '\t'
+					case 'r':
+						c = '\r'
+					case 'n':
+						c = '\n'
+					default:
+						c = l.ch
+					}
 				}
+				runes = append(runes, c)
+				l.next()
 			}
-			runes = append(runes, c)
 			l.next()
+			val = string(runes)
 		}
-		l.next()
 		tok = STRING
-		val = string(runes)
 	default:
 		tok = ILLEGAL
 		val = fmt.Sprintf("unexpected %q", ch)
@@ -294,12 +373,17 @@ func (l *Lexer) scan() (Position, Token, string) {
 func (l *Lexer) ScanRegex() (Position, Token, string) {
 	pos, tok, val := l.scanRegex()
 	l.lastTok = tok
+	pos = l.reportPosition(pos)
+	l.lastError = nil
+	if tok == ILLEGAL {
+		l.lastError = &Error{Start: pos, End: l.reportPosition(l.pos), Msg: val}
+	}
 	return pos, tok, val
 }
 
 func (l *Lexer) scanRegex() (Position, Token, string) {
 	pos := l.pos
-	runes := []rune{}
+	prefix := ""
 	switch l.lastTok {
 	case DIV:
 		// Regex after '/' (the usual case)
@@ -307,30 +391,89 @@ func (l *Lexer) scanRegex() (Position, Token, string) {
 	case DIV_ASSIGN:
 		// Regex after '/=' (possible when regex starts with '=')
 		pos.Column -= 2
-		runes = append(runes, '=')
+		prefix = "="
 	default:
 		return l.pos, ILLEGAL, fmt.Sprintf("unexpected %s preceding regex", l.lastTok)
 	}
+	start := l.curOffset()
+	escaped := false
 	for l.ch != '/' {
 		c := l.ch
 		if c < 0 {
-			return l.pos, ILLEGAL, "didn't find end slash in regex"
+			return pos, ILLEGAL, "didn't find end slash in regex"
 		}
 		if c == '\r' || c == '\n' {
-			return l.pos, ILLEGAL, "can't have newline in regex"
+			return pos, ILLEGAL, "can't have newline in regex"
 		}
 		if c == '\\' {
-			l.next()
-			if l.ch != '/' {
-				runes = append(runes, '\\')
+			escaped = true
+			break
+		}
+		l.next()
+	}
+	var val string
+	if !escaped {
+		// Fast path: no escapes, so the token value is just a
+		// substring of src -- no rune-by-rune copy needed.
+		val = prefix + string(l.src[start:l.curOffset()])
+		l.next()
+	} else {
+		runes := []rune(prefix + string(l.src[start:l.offset-1]))
+		for l.ch != '/' {
+			c := l.ch
+			if c < 0 {
+				return pos, ILLEGAL, "didn't find end slash in regex"
 			}
-			c = l.ch
+			if c == '\r' || c == '\n' {
+				return pos, ILLEGAL, "can't have newline in regex"
+			}
+			if c == '\\' {
+				l.next()
+				if l.ch != '/' {
+					runes = append(runes, '\\')
+				}
+				c = l.ch
+			}
+			runes = append(runes, c)
+			l.next()
 		}
-		runes = append(runes, c)
 		l.next()
+		val = string(runes)
 	}
-	l.next()
-	return pos, REGEX, string(runes)
+	return pos, REGEX, val
+}
+
+// parseLineDirective recognizes a "#line NNN "filename"" directive,
+// as emitted by preprocessors and code generators that target AWK,
+// and uses it to override the Position reported for subsequent
+// tokens -- the same trick Go's compiler plays with "//line" pragmas
+// to keep error messages pointing at the original source. Line
+// numbering resumes from NNN on the next physical line; the filename
+// persists until a later directive changes it. comment is whatever
+// followed the '#', so anything that doesn't match this exact shape
+// is left alone and treated as an ordinary comment.
+func (l *Lexer) parseLineDirective(comment string) {
+	fields := strings.Fields(comment)
+	if len(fields) < 2 || fields[0] != "line" {
+		return
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		return
+	}
+	if len(fields) != 3 {
+		return
+	}
+	name := fields[2]
+	if len(name) < 3 || name[0] != '"' || name[len(name)-1] != '"' {
+		return
+	}
+	// By the time we get here, the comment scan has already read the
+	// newline ending the directive into l.ch, so l.nextPos.Line is
+	// already the line after it -- exactly where numbering should
+	// resume from n.
+	l.lineDelta = n - l.nextPos.Line
+	l.curFile = name[1 : len(name)-1]
 }
 
 func (l *Lexer) next() {
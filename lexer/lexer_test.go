@@ -0,0 +1,189 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+// scanAll runs the lexer until EOF or the first ILLEGAL token and
+// returns the (token, value) pairs it produced before that, so tests
+// can assert on a whole token stream at once.
+func scanAll(t *testing.T, src string) []struct {
+	tok Token
+	val string
+} {
+	t.Helper()
+	l := NewLexer([]byte(src))
+	var toks []struct {
+		tok Token
+		val string
+	}
+	for {
+		_, tok, val := l.Scan()
+		if tok == EOF || tok == ILLEGAL {
+			break
+		}
+		toks = append(toks, struct {
+			tok Token
+			val string
+		}{tok, val})
+	}
+	return toks
+}
+
+func TestScanName(t *testing.T) {
+	toks := scanAll(t, "abc def\n")
+	want := []string{"abc", "def"}
+	var got []string
+	for _, tk := range toks {
+		if tk.tok == NAME {
+			got = append(got, tk.val)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("token %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScanNumber(t *testing.T) {
+	toks := scanAll(t, "123 45.6\n")
+	var got []string
+	for _, tk := range toks {
+		if tk.tok == NUMBER {
+			got = append(got, tk.val)
+		}
+	}
+	want := []string{"123", "45.6"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("token %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScanStringNoEscapes(t *testing.T) {
+	l := NewLexer([]byte(`"hello world" x`))
+	_, tok, val := l.Scan()
+	if tok != STRING || val != "hello world" {
+		t.Fatalf("got (%v, %q), want (STRING, %q)", tok, val, "hello world")
+	}
+	_, tok, val = l.Scan()
+	if tok != NAME || val != "x" {
+		t.Fatalf("token after string: got (%v, %q), want (NAME, %q)", tok, val, "x")
+	}
+}
+
+func TestScanStringWithEscapes(t *testing.T) {
+	l := NewLexer([]byte(`"a\tb"`))
+	_, tok, val := l.Scan()
+	if tok != STRING || val != "a\tb" {
+		t.Fatalf("got (%v, %q), want (STRING, %q)", tok, val, "a\tb")
+	}
+}
+
+func TestScanRegexNoEscapes(t *testing.T) {
+	l := NewLexer([]byte("/abc/"))
+	_, tok, _ := l.Scan() // DIV
+	if tok != DIV {
+		t.Fatalf("expected DIV, got %v", tok)
+	}
+	_, tok, val := l.ScanRegex()
+	if tok != REGEX || val != "abc" {
+		t.Fatalf("got (%v, %q), want (REGEX, %q)", tok, val, "abc")
+	}
+}
+
+func TestScanRegexWithEscapes(t *testing.T) {
+	l := NewLexer([]byte(`/a\/b/`))
+	l.Scan() // DIV
+	_, tok, val := l.ScanRegex()
+	if tok != REGEX || val != "a/b" {
+		t.Fatalf("got (%v, %q), want (REGEX, %q)", tok, val, "a/b")
+	}
+}
+
+func TestLineDirective(t *testing.T) {
+	src := "x\n#line 10 \"gen.awk\"\ny\n"
+	l := NewLexer([]byte(src))
+	pos, tok, _ := l.Scan() // x
+	if tok != NAME || pos.Line != 1 {
+		t.Fatalf("x: got tok=%v line=%d, want NAME line=1", tok, pos.Line)
+	}
+	l.Scan()               // NEWLINE after x
+	l.Scan()               // NEWLINE ending the #line directive's own comment line
+	pos, tok, _ = l.Scan() // y, after the #line directive
+	if tok != NAME {
+		t.Fatalf("expected NAME for y, got %v", tok)
+	}
+	if pos.Line != 10 || pos.File != "gen.awk" {
+		t.Errorf("got line=%d file=%q, want line=10 file=%q", pos.Line, pos.File, "gen.awk")
+	}
+}
+
+func TestLastError(t *testing.T) {
+	l := NewLexer([]byte(`"unterminated`))
+	_, tok, msg := l.Scan()
+	if tok != ILLEGAL {
+		t.Fatalf("expected ILLEGAL, got %v", tok)
+	}
+	err := l.LastError()
+	if err == nil {
+		t.Fatal("expected LastError to be non-nil after an ILLEGAL token")
+	}
+	if err.Msg != msg {
+		t.Errorf("err.Msg = %q, want %q (the value Scan returned)", err.Msg, msg)
+	}
+	if err.Start == (err.End) {
+		t.Errorf("expected Start and End to differ so callers can underline a range, got %+v for both", err.Start)
+	}
+}
+
+func BenchmarkScanNames(b *testing.B) {
+	src := []byte(strings.Repeat("abcdef ghijkl ", 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := NewLexer(src)
+		for {
+			_, tok, _ := l.Scan()
+			if tok == EOF || tok == ILLEGAL {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkScanNumbers(b *testing.B) {
+	src := []byte(strings.Repeat("123 45.6 ", 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := NewLexer(src)
+		for {
+			_, tok, _ := l.Scan()
+			if tok == EOF || tok == ILLEGAL {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkScanStrings(b *testing.B) {
+	src := []byte(strings.Repeat(`"a plain string with no escapes" `, 1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := NewLexer(src)
+		for {
+			_, tok, _ := l.Scan()
+			if tok == EOF || tok == ILLEGAL {
+				break
+			}
+		}
+	}
+}